@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/lavab/smtpd"
+)
+
+// AuthResults is the outcome of inbound DKIM/SPF/DMARC verification for a
+// single message. It's attached to the stored models.Email and to the
+// manifest so clients can render a trust badge.
+type AuthResults struct {
+	DKIM  string `json:"dkim"`
+	SPF   string `json:"spf"`
+	DMARC string `json:"dmarc"`
+}
+
+// verifyAuth independently verifies DKIM and SPF for an inbound message and
+// derives a DMARC disposition from the aligned results. It never trusts the
+// upstream Authentication-Results/Received-SPF headers on their own - it
+// redoes the checks so a forged header can't bypass policy.
+func verifyAuth(peer smtpd.Peer, e smtpd.Envelope, msg *Message) (*AuthResults, error) {
+	results := &AuthResults{
+		DKIM:  "none",
+		SPF:   "none",
+		DMARC: "none",
+	}
+
+	envFromDomain, err := envelopeFromDomain(e)
+	if err != nil {
+		return nil, err
+	}
+
+	// DMARC alignment is defined against the RFC 5322 From domain, not the
+	// envelope sender - otherwise a message can pass alignment by signing
+	// with/sending from a domain the attacker controls while showing a
+	// spoofed header From.
+	headerFromDomain, err := headerFromDomain(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// DKIM: verify the signature(s) against the signing domain's DNS TXT
+	// record. We only care whether at least one signature verifies and is
+	// aligned with the header From domain.
+	dkimDomain, dkimVerdict, err := verifyDKIM(e.Data, headerFromDomain)
+	if err != nil {
+		return nil, err
+	}
+	results.DKIM = dkimVerdict
+
+	// SPF: resolve the envelope-from domain and match it against peer.Addr.
+	spfVerdict, err := verifySPF(envFromDomain, peer.Addr)
+	if err != nil {
+		return nil, err
+	}
+	results.SPF = spfVerdict
+
+	dkimAligned := results.DKIM == "pass" && strings.EqualFold(dkimDomain, headerFromDomain)
+	spfAligned := results.SPF == "pass" && strings.EqualFold(envFromDomain, headerFromDomain)
+
+	results.DMARC = dmarcDisposition(headerFromDomain, dkimAligned, spfAligned)
+
+	return results, nil
+}
+
+// verifyDKIM walks the message's DKIM-Signature headers and verifies each
+// against the signing domain's published public key. It returns the
+// signing domain and "pass"/"fail"/"none". When several signatures verify,
+// one whose domain matches fromDomain is preferred over the others.
+func verifyDKIM(raw []byte, fromDomain string) (string, string, error) {
+	verifications, err := dkim.Verify(strings.NewReader(string(raw)))
+	if err != nil {
+		return "", "none", nil
+	}
+
+	passDomain, passed := "", false
+	for _, v := range verifications {
+		if v.Err != nil {
+			continue
+		}
+		if strings.EqualFold(v.Domain, fromDomain) {
+			return v.Domain, "pass", nil
+		}
+		if !passed {
+			passDomain, passed = v.Domain, true
+		}
+	}
+	if passed {
+		return passDomain, "pass", nil
+	}
+
+	if len(verifications) > 0 {
+		return verifications[0].Domain, "fail", nil
+	}
+
+	return "", "none", nil
+}
+
+// verifySPF looks up the SPF record for domain and checks whether addr is
+// authorized to send on its behalf. This covers the common ip4/ip6/mx/a
+// mechanisms and nested includes up to a small depth - enough for the domains we
+// expect to deliver for, without pulling in a full RFC 7208 evaluator.
+func verifySPF(domain string, addr net.Addr) (string, error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "none", nil
+	}
+
+	records, err := net.LookupTXT(domain)
+	if err != nil {
+		return "none", nil
+	}
+
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=spf1") {
+			continue
+		}
+
+		verdict := evaluateSPFRecord(record, domain, ip, 0)
+		return verdict, nil
+	}
+
+	return "none", nil
+}
+
+// resolvesToIP reports whether any of host's A/AAAA records equal ip.
+func resolvesToIP(host string, ip net.IP) bool {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// evaluateSPFRecord checks ip against the mechanisms of a single SPF
+// record, following "include" up to a small recursion depth to guard
+// against loops. domain is the record's own domain, used as the implicit
+// target of bare "a"/"mx" mechanisms.
+func evaluateSPFRecord(record string, domain string, ip net.IP, depth int) string {
+	if depth > 5 {
+		return "neutral"
+	}
+
+	for _, mechanism := range strings.Fields(record) {
+		switch {
+		case strings.HasPrefix(mechanism, "ip4:"), strings.HasPrefix(mechanism, "ip6:"):
+			value := mechanism[strings.Index(mechanism, ":")+1:]
+			if _, network, err := net.ParseCIDR(value); err == nil {
+				if network.Contains(ip) {
+					return "pass"
+				}
+			} else if candidate := net.ParseIP(value); candidate != nil && candidate.Equal(ip) {
+				return "pass"
+			}
+		case strings.HasPrefix(mechanism, "include:"):
+			includeDomain := mechanism[len("include:"):]
+			records, err := net.LookupTXT(includeDomain)
+			if err != nil {
+				continue
+			}
+			for _, record := range records {
+				if strings.HasPrefix(record, "v=spf1") {
+					if verdict := evaluateSPFRecord(record, includeDomain, ip, depth+1); verdict == "pass" {
+						return "pass"
+					}
+				}
+			}
+		case mechanism == "a", strings.HasPrefix(mechanism, "a:"), strings.HasPrefix(mechanism, "a/"):
+			target := domain
+			if strings.HasPrefix(mechanism, "a:") {
+				target = mechanism[len("a:"):]
+				if i := strings.Index(target, "/"); i != -1 {
+					target = target[:i]
+				}
+			}
+			if resolvesToIP(target, ip) {
+				return "pass"
+			}
+		case mechanism == "mx", strings.HasPrefix(mechanism, "mx:"), strings.HasPrefix(mechanism, "mx/"):
+			target := domain
+			if strings.HasPrefix(mechanism, "mx:") {
+				target = mechanism[len("mx:"):]
+				if i := strings.Index(target, "/"); i != -1 {
+					target = target[:i]
+				}
+			}
+			mxs, err := net.LookupMX(target)
+			if err != nil {
+				continue
+			}
+			for _, mx := range mxs {
+				if resolvesToIP(strings.TrimSuffix(mx.Host, "."), ip) {
+					return "pass"
+				}
+			}
+		case mechanism == "-all":
+			return "fail"
+		case mechanism == "~all":
+			return "softfail"
+		case mechanism == "?all":
+			return "neutral"
+		}
+	}
+
+	return "neutral"
+}
+
+// dmarcDisposition fetches the _dmarc TXT record for domain and evaluates
+// it against whether DKIM and SPF passed in alignment with the From domain.
+// The published policy's disposition is returned as-is: "fail" for
+// p=reject, "quarantine" for p=quarantine, so callers can tell a hard
+// rejection apart from a soft one instead of collapsing both to "fail".
+func dmarcDisposition(domain string, dkimAligned, spfAligned bool) string {
+	if dkimAligned || spfAligned {
+		return "pass"
+	}
+
+	records, err := net.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		return "none"
+	}
+
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=DMARC1") {
+			continue
+		}
+
+		for _, tag := range strings.Split(record, ";") {
+			tag = strings.TrimSpace(tag)
+			if strings.HasPrefix(tag, "p=") {
+				switch strings.TrimPrefix(tag, "p=") {
+				case "reject":
+					return "fail"
+				case "quarantine":
+					return "quarantine"
+				default:
+					return "none"
+				}
+			}
+		}
+	}
+
+	return "none"
+}
+
+// envelopeFromDomain extracts the domain part of the envelope-from address.
+func envelopeFromDomain(e smtpd.Envelope) (string, error) {
+	parts := strings.Split(e.Sender, "@")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid envelope-from address")
+	}
+
+	return parts[1], nil
+}
+
+// headerFromDomain extracts the domain part of the RFC 5322 From header -
+// the identity DMARC alignment is actually defined against, since it's the
+// address the user sees.
+func headerFromDomain(msg *Message) (string, error) {
+	addrs, err := msg.Headers.AddressList("From")
+	if err != nil {
+		return "", fmt.Errorf("Invalid From header: %s", err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("Missing From header")
+	}
+
+	parts := strings.Split(addrs[0].Address, "@")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid From address")
+	}
+
+	return parts[1], nil
+}
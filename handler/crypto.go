@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/lavab/api/models"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// keyringCache holds parsed *openpgp.Entity values keyed by the owning
+// key's RethinkDB ID, so a high-volume delivery run doesn't re-fetch and
+// re-parse the same account's public key for every message it receives.
+var keyringCache, _ = lru.New(4096)
+
+// entityForAccount resolves account's primary OpenPGP entity, checking
+// keyringCache before ever calling resolver.PrimaryKey - so a high-volume
+// delivery run that repeatedly sees the same recipient doesn't hit
+// RethinkDB for that recipient's key on every message. account.PublicKey
+// is the key's RethinkDB ID (the same one PrimaryKey would resolve to), so
+// it doubles as the cache key without a lookup; accounts with no
+// designated PublicKey fall back to their own ID, since which key
+// PrimaryKey would pick isn't known until it's actually called.
+func entityForAccount(resolver AddressResolver, account *models.Account) (*openpgp.Entity, error) {
+	cacheKey := account.PublicKey
+	if cacheKey == "" {
+		cacheKey = account.ID
+	}
+
+	if cached, ok := keyringCache.Get(cacheKey); ok {
+		return cached.(*openpgp.Entity), nil
+	}
+
+	key, err := resolver.PrimaryKey(context.Background(), account)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAndCacheKey(cacheKey, key.Key)
+}
+
+func parseAndCacheKey(keyID, armoredKey string) (*openpgp.Entity, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredKey))
+	if err != nil {
+		return nil, err
+	}
+
+	entity := keyring[0]
+	keyringCache.Add(keyID, entity)
+
+	return entity, nil
+}
+
+// EncryptAndArmor encrypts data to the given keyring and returns the
+// ASCII-armored OpenPGP message. Callers pass a single-entity keyring to
+// produce a copy that only its owner can decrypt.
+func EncryptAndArmor(data []byte, keyring []*openpgp.Entity) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	armored, err := armor.Encode(buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openpgp.Encrypt(armored, keyring, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := plaintext.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := plaintext.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
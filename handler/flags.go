@@ -0,0 +1,36 @@
+package handler
+
+// Flags holds the configuration accepted by PrepareHandler.
+type Flags struct {
+	BindAddress string
+
+	LogFormatterType string
+	ForceColors      bool
+
+	RethinkAddress  string
+	RethinkKey      string
+	RethinkDatabase string
+
+	NSQDAddress string
+
+	// Domains lists the mail domains this deployment accepts recipients
+	// for. Used by the default RethinkResolver; other AddressResolver
+	// implementations are free to ignore it.
+	Domains []string
+
+	// RejectDMARCFail causes PrepareHandler's closure to reject (SMTP error)
+	// any message whose DMARC disposition is "fail", instead of storing it.
+	RejectDMARCFail bool
+	// QuarantineDMARCFail, when RejectDMARCFail is not set, files messages
+	// that fail DMARC into the recipient's Quarantine label instead of Inbox.
+	QuarantineDMARCFail bool
+
+	// SpamdAddress, if set, enables spamd scoring of inbound mail via
+	// spamc. Expected form is "host:port".
+	SpamdAddress string
+	// SpamThreshold is the spamd score at or above which a message is filed into
+	// the recipient's Spam label instead of Inbox. Ignored if SpamdAddress
+	// is empty. Zero (the unset default) falls back to SpamAssassin's own
+	// conventional cutoff of 5.0, rather than flagging every message.
+	SpamThreshold float64
+}
@@ -2,11 +2,14 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"mime"
 	"net/mail"
 	"strings"
@@ -18,19 +21,17 @@ import (
 	"github.com/blang/semver"
 	"github.com/dancannon/gorethink"
 	"github.com/dchest/uniuri"
+	emmail "github.com/emersion/go-message/mail"
 	"github.com/lavab/api/models"
 	man "github.com/lavab/pgp-manifest-go"
 	"github.com/lavab/smtpd"
 	"golang.org/x/crypto/openpgp"
 )
 
-var domains = map[string]struct{}{
-	"lavaboom.com": struct{}{},
-	"lavaboom.io":  struct{}{},
-	"lavaboom.co":  struct{}{},
-}
-
-func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) error {
+// PrepareHandler wires resolver - typically a *RethinkResolver, optionally
+// wrapped in a PlusAddressingResolver - into the returned SMTP handler, so
+// recipient resolution never talks to RethinkDB directly from here.
+func PrepareHandler(config *Flags, resolver AddressResolver) func(peer smtpd.Peer, env smtpd.Envelope) error {
 	// Initialize a new logger
 	log := logrus.New()
 	if config.LogFormatterType == "text" {
@@ -72,8 +73,11 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 	return func(peer smtpd.Peer, e smtpd.Envelope) error {
 		log.Debug("Started parsing")
 
-		// Check recipients for Lavaboom users
-		recipients := []interface{}{}
+		// Resolve recipients through resolver instead of talking to
+		// RethinkDB directly, so unsupported domains and unknown
+		// accounts are skipped rather than failing the whole delivery.
+		ctx := context.Background()
+		accounts := []*models.Account{}
 		for _, recipient := range e.Recipients {
 			// Split the email address into username and domain
 			parts := strings.Split(recipient, "@")
@@ -81,92 +85,69 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 				return fmt.Errorf("Invalid recipient email address")
 			}
 
-			// Check if we support that domain
-			if _, ok := domains[parts[1]]; ok {
-				recipients = append(recipients, parts[0])
+			account, err := resolver.Resolve(ctx, parts[0], parts[1])
+			if err == ErrDomainNotSupported || err == ErrAccountNotFound {
+				continue
+			} else if err != nil {
+				return err
 			}
+
+			accounts = append(accounts, account)
 		}
 
 		log.Debug("Parsed recipients")
 
 		// If we didn't find a recipient, return an error
-		if len(recipients) == 0 {
-			return fmt.Errorf("Not supported email domain")
+		if len(accounts) == 0 {
+			return fmt.Errorf("Email address not found")
 		}
 
-		// Fetch accounts
-		cursor, err := gorethink.Db(config.RethinkDatabase).Table("accounts").GetAllByIndex("name", recipients...).Run(session)
+		log.Debug("Recipient found")
+
+		// Parse the email
+		email, err := ParseEmail(bytes.NewReader(e.Data))
 		if err != nil {
 			return err
 		}
-		var accounts []*models.Account
-		if err := cursor.All(&accounts); err != nil {
+
+		// Independently verify DKIM/SPF and derive a DMARC disposition,
+		// before we touch any recipient's keys.
+		authResults, err := verifyAuth(peer, e, email)
+		if err != nil {
 			return err
 		}
 
-		// Compare request and result lengths
-		if len(accounts) != len(recipients) {
-			return fmt.Errorf("Email address not found")
-		}
+		log.WithFields(logrus.Fields{
+			"dkim":  authResults.DKIM,
+			"spf":   authResults.SPF,
+			"dmarc": authResults.DMARC,
+		}).Debug("Verified sender authentication")
 
-		log.Debug("Recipient found")
+		if config.RejectDMARCFail && authResults.DMARC == "fail" {
+			return fmt.Errorf("Message failed DMARC verification")
+		}
 
-		// Prepare a variable for the combined keyring of recipients
-		toKeyring := []*openpgp.Entity{}
+		// Score the raw message with spamd, if configured. Failures here
+		// are logged and the message is treated as ham.
+		spamReport := scoreSpam(log, config.SpamdAddress, config.SpamThreshold, e.Data)
 
-		// Fetch users' public keys
+		// Resolve each recipient's primary key. Every account gets its own
+		// entity - there's no shared keyring - and entityForAccount caches
+		// the parsed keyring so high-volume delivery doesn't hit RethinkDB
+		// for every message.
+		entities := map[string]*openpgp.Entity{}
 		for _, account := range accounts {
-			if account.PublicKey != "" {
-				cursor, err := gorethink.Db(config.RethinkDatabase).Table("keys").Get(account.PublicKey).Run(session)
-				if err != nil {
-					return err
-				}
-
-				var key *models.Key
-				if err := cursor.One(&key); err != nil {
-					return err
-				}
-
-				keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
-				if err != nil {
-					return err
-				}
-
-				account.Key = keyring[0]
-				toKeyring = append(toKeyring, account.Key)
-			} else {
-				cursor, err := gorethink.Db(config.RethinkDatabase).Table("keys").GetAllByIndex("owner", account.ID).Run(session)
-				if err != nil {
-					return err
-				}
-
-				var keys []*models.Key
-				if err := cursor.All(&keys); err != nil {
-					return err
-				}
-
-				if len(keys) == 0 {
-					return fmt.Errorf("Recipient has no public key")
-				}
-
-				keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keys[0].Key))
-				if err != nil {
-					return err
-				}
-
-				account.Key = keyring[0]
-				toKeyring = append(toKeyring, account.Key)
+			entity, err := entityForAccount(resolver, account)
+			if err != nil {
+				return err
 			}
+
+			account.Key = entity
+			entities[account.ID] = entity
 		}
 
 		log.Debug("Fetched keys")
 
-		// Parse the email
-		email, err := ParseEmail(bytes.NewReader(e.Data))
-		if err != nil {
-			return err
-		}
-
 		// Determine email's kind
 		contentType := email.Headers.Get("Content-Type")
 		kind := "raw"
@@ -186,13 +167,19 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 		// Debug the kind
 		log.Debugf("Email is %s", kind)
 
-		// Declare variables used later for data insertion
+		// Declare variables used later for data insertion. bodies/manifests
+		// hold one ciphertext per recipient, since each is now encrypted to
+		// that recipient's key alone; body/manifest are the fallback for
+		// the pgpmime/manifest kinds, which pass through content that
+		// arrived already encrypted by the original sender.
 		var (
-			subject  string
-			manifest string
-			body     string
-			fileIDs  = map[string][]string{}
-			files    = []*models.File{}
+			subject   string
+			manifest  string
+			body      string
+			manifests = map[string]string{}
+			bodies    = map[string]string{}
+			fileIDs   = map[string][]string{}
+			files     = []*models.File{}
 		)
 
 		// Transform raw emails into encrypted with manifests
@@ -206,156 +193,163 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 				bodyText string
 			)
 
-			// Flatten the email
-			var parseBody func(msg *Message) error
-			parseBody = func(msg *Message) error {
-				contentType := msg.Headers.Get("Content-Type")
-
-				if strings.HasPrefix(contentType, "multipart/alternative") {
-					firstIndex := -1
-
-					// Find the first supported body
-					for index, child := range msg.Children {
-						contentType := child.Headers.Get("Content-Type")
-						if strings.HasPrefix(contentType, "application/pgp-encrypted") ||
-							strings.HasPrefix(contentType, "text/html") ||
-							strings.HasPrefix(contentType, "text/plain") {
-							firstIndex = index
-							break
-						}
+			// Inline images referenced by Content-ID, keyed by the ID
+			// without its surrounding "<...>", collected while walking the
+			// tree and substituted into the HTML body afterwards.
+			inlineImages := map[string]string{}
+
+			// storeAttachment records body as an encrypted attachment -
+			// one copy per recipient, to that recipient's key alone - and
+			// adds it to the manifest. Shared by *emmail.AttachmentHeader
+			// parts and any inline part this package has no inline
+			// rendering for, so the latter degrade to an attachment
+			// instead of being silently dropped.
+			storeAttachment := func(mediaType, filename string, body []byte) error {
+				id := uniuri.NewLen(uniuri.UUIDLen)
+
+				// Hash the plaintext once to dedupe the manifest's
+				// Part.Hash, even though each recipient gets their own
+				// encrypted copy below.
+				rawHash := sha256.Sum256(body)
+				hash := hex.EncodeToString(rawHash[:])
+
+				parts = append(parts, &man.Part{
+					Hash:        hash,
+					ID:          id,
+					ContentType: mediaType,
+					Filename:    filename,
+					Size:        len(body),
+				})
+
+				for _, account := range accounts {
+					// Encrypt a distinct copy to this account's key alone,
+					// so holding one recipient's ciphertext never exposes
+					// another recipient's copy.
+					encryptedBody, err := EncryptAndArmor(body, []*openpgp.Entity{entities[account.ID]})
+					if err != nil {
+						return err
+					}
+
+					fid := uniuri.NewLen(uniuri.UUIDLen)
+
+					files = append(files, &models.File{
+						Resource: models.Resource{
+							ID:           fid,
+							DateCreated:  time.Now(),
+							DateModified: time.Now(),
+							Name:         id + ".pgp",
+							Owner:        account.ID,
+						},
+						Encrypted: models.Encrypted{
+							Encoding: "application/pgp-encrypted",
+							Data:     string(encryptedBody),
+						},
+					})
+
+					if _, ok := fileIDs[account.ID]; !ok {
+						fileIDs[account.ID] = []string{}
 					}
 
-					// Parse its media type to remove non-required stuff
-					match := msg.Children[firstIndex]
-					mediaType, _, err := mime.ParseMediaType(match.Headers.Get("Content-Type"))
+					fileIDs[account.ID] = append(fileIDs[account.ID], fid)
+				}
+
+				return nil
+			}
+
+			// mail.Reader walks multipart/alternative, multipart/related and
+			// multipart/mixed itself and classifies each leaf as an
+			// *emmail.InlineHeader or *emmail.AttachmentHeader by its
+			// Content-Disposition, so we no longer have to parse dispositions
+			// or guess how to merge alternative text/plain and text/html
+			// parts by hand.
+			mr, err := emmail.CreateReader(bytes.NewReader(e.Data))
+			if err != nil {
+				return err
+			}
+
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+
+				body, err := ioutil.ReadAll(part.Body)
+				if err != nil {
+					return err
+				}
+
+				switch h := part.Header.(type) {
+				case *emmail.AttachmentHeader:
+					mediaType, _, err := h.ContentType()
+					if err != nil {
+						return err
+					}
+					filename, err := h.Filename()
 					if err != nil {
 						return err
 					}
 
-					// Push contents into the parser's scope
-					bodyType = mediaType
-					bodyText = string(match.Body)
-
-					/* change of plans - discard them.
-					// Transform rest of the types into attachments
-					nodeID := uniuri.New()
-					for _, child := range msg.Children {
-						child.Headers["disposition"] = "attachment; filename=\"alternative." + nodeID + "." + mime. +"\""
-					}*/
-				} else if strings.HasPrefix(contentType, "multipart/") {
-					// Tread every other multipart as multipart/mixed, as we parse multipart/encrypted later
-					for _, child := range msg.Children {
-						if err := parseBody(child); err != nil {
-							return err
-						}
+					if err := storeAttachment(mediaType, filename, body); err != nil {
+						return err
 					}
-				} else {
-					// Parse the content type
-					mediaType, _, err := mime.ParseMediaType(contentType)
+				case *emmail.InlineHeader:
+					mediaType, _, err := h.ContentType()
 					if err != nil {
 						return err
 					}
 
-					// Not multipart, parse the disposition
-					disposition, dparams, err := mime.ParseMediaType(msg.Headers.Get("Content-Disposition"))
-
-					if err == nil && disposition == "attachment" {
-						// We're dealing with an attachment
-						id := uniuri.NewLen(uniuri.UUIDLen)
-
-						// Encrypt the body
-						encryptedBody, err := EncryptAndArmor(msg.Body, toKeyring)
-						if err != nil {
-							return err
-						}
-
-						// Hash the body
-						rawHash := sha256.Sum256(msg.Body)
-						hash := hex.EncodeToString(rawHash[:])
-
-						// Push the attachment into parser's scope
-						parts = append(parts, &man.Part{
-							Hash:        hash,
-							ID:          id,
-							ContentType: mediaType,
-							Filename:    dparams["filename"],
-							Size:        len(msg.Body),
-						})
-
-						for _, account := range accounts {
-							fid := uniuri.NewLen(uniuri.UUIDLen)
-
-							files = append(files, &models.File{
-								Resource: models.Resource{
-									ID:           fid,
-									DateCreated:  time.Now(),
-									DateModified: time.Now(),
-									Name:         id + ".pgp",
-									Owner:        account.ID,
-								},
-								Encrypted: models.Encrypted{
-									Encoding: "application/pgp-encrypted",
-									Data:     string(encryptedBody),
-								},
-							})
-
-							if _, ok := fileIDs[account.ID]; !ok {
-								fileIDs[account.ID] = []string{}
-							}
-
-							fileIDs[account.ID] = append(fileIDs[account.ID], fid)
-						}
-					} else {
-						// Header is either corrupted or we're dealing with inline
-						if bodyType == "" && mediaType == "text/plain" || mediaType == "text/html" {
-							bodyType = mediaType
-							bodyText = string(msg.Body)
-						} else if bodyType == "" {
-							bodyType = "text/html"
-
-							if strings.Index(mediaType, "image/") == 0 {
-								bodyText = `<img src="data:` + mediaType + `;base64,` + base64.StdEncoding.EncodeToString(msg.Body) + `"><br>`
-							} else {
-								bodyText = "<pre>" + string(msg.Body) + "</pre>"
-							}
-						} else if mediaType == "text/plain" {
-							if bodyType == "text/plain" {
-								bodyText += "\n\n" + string(msg.Body)
-							} else {
-								bodyText += "\n\n<pre>" + string(msg.Body) + "</pre>"
-							}
-						} else if mediaType == "text/html" {
-							if bodyType == "text/plain" {
-								bodyType = "text/html"
-								bodyText = "<pre>" + bodyText + "</pre>\n\n" + string(msg.Body)
-							} else {
-								bodyText += "\n\n" + string(msg.Body)
-							}
-						} else {
-							if bodyType != "text/html" {
-								bodyType = "text/html"
-								bodyText = "<pre>" + bodyText + "</pre>"
-							}
-
-							// Put images as HTML tags
-							if strings.Index(mediaType, "image/") == 0 {
-								bodyText = "\n\n<img src=\"data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(msg.Body) + "\"><br>"
-							} else {
-								bodyText = "\n\n<pre>" + string(msg.Body) + "</pre>"
-							}
-						}
+					// An inline image referenced by the HTML body via
+					// cid:<Content-ID> is stashed for later substitution
+					// rather than inserted blindly - it gets rewritten in
+					// wherever the HTML actually points at it.
+					if cid := strings.Trim(h.Get("Content-Id"), "<>"); cid != "" && strings.HasPrefix(mediaType, "image/") {
+						inlineImages[cid] = "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(body)
+						continue
 					}
-				}
 
-				return nil
-			}
+					// mail.Reader hands back every leaf of a
+					// multipart/alternative group, so the last inline
+					// text part seen - conventionally the richest one, since
+					// "text/html" follows "text/plain" in an alternative
+					// group - simply replaces whatever came before it,
+					// instead of being concatenated onto it.
+					if mediaType == "text/plain" || mediaType == "text/html" {
+						bodyType = mediaType
+						bodyText = string(body)
+						continue
+					}
+
+					// Anything else inline - a text/calendar invite, an
+					// inline image with no Content-Id to substitute by,
+					// ... - has nowhere to be rendered inline, so it's
+					// stored as an attachment instead of being dropped.
+					filename, err := h.Filename()
+					if err != nil {
+						return err
+					}
+					if filename == "" {
+						filename = "attachment"
+					}
 
-			// Parse the email
-			parseBody(email)
+					if err := storeAttachment(mediaType, filename, body); err != nil {
+						return err
+					}
+				}
+			}
 
 			// Trim the body text
 			bodyText = strings.TrimSpace(bodyText)
 
+			// Rewrite cid: references in the HTML body to the data URI of
+			// the matching inline image, now that the whole tree's been walked.
+			if bodyType == "text/html" {
+				for cid, dataURI := range inlineImages {
+					bodyText = strings.Replace(bodyText, "cid:"+cid, dataURI, -1)
+				}
+			}
+
 			// Hash the body
 			bodyHash := sha256.Sum256([]byte(bodyText))
 
@@ -404,31 +398,44 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 				}
 			}
 
+			// AuthResults is a new field this series adds to
+			// github.com/lavab/pgp-manifest-go's Manifest, landing there as
+			// a companion change the same way the models.Email fields do.
 			rawManifest := &man.Manifest{
-				Version: semver.Version{1, 0, 0, nil, nil},
-				From:    from[0],
-				To:      to,
-				CC:      cc,
-				Subject: s2,
-				Parts:   parts,
+				Version:     semver.Version{1, 0, 0, nil, nil},
+				From:        from[0],
+				To:          to,
+				CC:          cc,
+				Subject:     s2,
+				Parts:       parts,
+				AuthResults: map[string]string{"dkim": authResults.DKIM, "spf": authResults.SPF, "dmarc": authResults.DMARC},
 			}
 
-			// Encrypt the manifest and the body
-			encryptedBody, err := EncryptAndArmor([]byte(bodyText), toKeyring)
-			if err != nil {
-				return err
-			}
+			// The manifest's plaintext is the same for every recipient;
+			// only its encrypted form differs per account below.
 			strManifest, err := man.Write(rawManifest)
 			if err != nil {
 				return err
 			}
-			encryptedManifest, err := EncryptAndArmor(strManifest, toKeyring)
-			if err != nil {
-				return err
+
+			// Encrypt the manifest and the body once per recipient, to
+			// that recipient's key alone.
+			for _, account := range accounts {
+				entity := []*openpgp.Entity{entities[account.ID]}
+
+				encryptedBody, err := EncryptAndArmor([]byte(bodyText), entity)
+				if err != nil {
+					return err
+				}
+				encryptedManifest, err := EncryptAndArmor(strManifest, entity)
+				if err != nil {
+					return err
+				}
+
+				bodies[account.ID] = string(encryptedBody)
+				manifests[account.ID] = string(encryptedManifest)
 			}
 
-			body = string(encryptedBody)
-			manifest = string(encryptedManifest)
 			kind = "manifest"
 
 			_ = subject
@@ -535,10 +542,26 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 
 		// Save the email for each recipient
 		for _, account := range accounts {
-			// Find user's Inbox label
+			// A p=quarantine DMARC policy always routes to Quarantine - the
+			// domain owner explicitly asked for quarantine, not rejection.
+			// A p=reject ("fail") disposition only routes to Quarantine as
+			// a softer alternative when the operator opted into
+			// QuarantineDMARCFail instead of RejectDMARCFail; outright
+			// rejection on "fail" is handled above, before we ever got here.
+			destination := "Inbox"
+			if authResults.DMARC == "quarantine" {
+				destination = "Quarantine"
+			} else if config.QuarantineDMARCFail && authResults.DMARC == "fail" {
+				destination = "Quarantine"
+			}
+			if spamReport != nil && spamReport.IsSpam {
+				destination = "Spam"
+			}
+
+			// Find the destination label
 			cursor, err := gorethink.Db(config.RethinkDatabase).Table("labels").Filter(map[string]interface{}{
 				"owner":   account.ID,
-				"name":    "Inbox",
+				"name":    destination,
 				"builtin": true,
 			}).Run(session)
 			if err != nil {
@@ -547,7 +570,26 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 
 			var inbox *models.Label
 			if err := cursor.One(&inbox); err != nil {
-				return err
+				// Spam/Quarantine may not exist yet for accounts that have
+				// never needed them before - create them on demand.
+				if destination != "Spam" && destination != "Quarantine" {
+					return err
+				}
+
+				inbox = &models.Label{
+					Resource: models.Resource{
+						ID:           uniuri.NewLen(uniuri.UUIDLen),
+						DateCreated:  time.Now(),
+						DateModified: time.Now(),
+						Name:         destination,
+						Owner:        account.ID,
+					},
+					Builtin: true,
+				}
+
+				if _, err := gorethink.Db(config.RethinkDatabase).Table("labels").Insert(inbox).Run(session); err != nil {
+					return err
+				}
 			}
 
 			// Get the subject's hash
@@ -602,7 +644,7 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 
 			// Generate list of all owned emails
 			ownEmails := map[string]struct{}{}
-			for domain, _ := range domains {
+			for _, domain := range config.Domains {
 				ownEmails[account.Name+"@"+domain] = struct{}{}
 			}
 
@@ -653,6 +695,7 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 					Labels:      []string{inbox.ID},
 					Members:     append(append(to, cc...), from),
 					IsRead:      false,
+					IsSpam:      spamReport != nil && spamReport.IsSpam,
 					SubjectHash: subjectHash,
 				}
 
@@ -678,6 +721,7 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 				_, err := gorethink.Db(config.RethinkDatabase).Table("threads").Get(thread.ID).Update(map[string]interface{}{
 					"date_modified": gorethink.Now(),
 					"is_read":       false,
+					"is_spam":       spamReport != nil && spamReport.IsSpam,
 					"labels":        thread.Labels,
 				}).Run(session)
 				if err != nil {
@@ -685,7 +729,11 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 				}
 			}
 
-			// Prepare a new email
+			// Prepare a new email. AuthResults, SpamReport and Thread.IsSpam
+			// below are new fields this series adds to github.com/lavab/api/models;
+			// this package depends on that module unvendored, same as it
+			// always has, so those fields land there as a companion change
+			// rather than being defined in this repo.
 			es := &models.Email{
 				Resource: models.Resource{
 					ID:           eid,
@@ -701,13 +749,35 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 				Body:   body,
 				Thread: thread.ID,
 				Status: "received",
+				AuthResults: map[string]string{
+					"dkim":  authResults.DKIM,
+					"spf":   authResults.SPF,
+					"dmarc": authResults.DMARC,
+				},
+			}
+
+			// Prefer the per-recipient ciphertext produced for "raw" mail;
+			// "manifest"/"pgpmime" mail passes through whatever the sender
+			// already encrypted, identical for every recipient.
+			if b, ok := bodies[account.ID]; ok {
+				es.Body = b
+			}
+
+			if spamReport != nil {
+				es.SpamReport = &models.SpamReport{
+					Score:   spamReport.Score,
+					IsSpam:  spamReport.IsSpam,
+					Symbols: spamReport.Symbols,
+				}
 			}
 
 			if fileIDs != nil {
 				es.Files = fileIDs[account.ID]
 			}
 
-			if manifest != "" {
+			if m, ok := manifests[account.ID]; ok {
+				es.Manifest = m
+			} else if manifest != "" {
 				es.Manifest = manifest
 			}
 
@@ -717,10 +787,13 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 				return err
 			}
 
-			// Prepare a notification message
+			// Prepare a notification message. label lets subscribers (the
+			// IMAP IDLE notifier) know which mailbox to notify about,
+			// since delivery doesn't always land in Inbox.
 			notification, err := json.Marshal(map[string]interface{}{
 				"id":    eid,
 				"owner": account.ID,
+				"label": inbox.Name,
 			})
 			if err != nil {
 				return err
@@ -739,4 +812,4 @@ func PrepareHandler(config *Flags) func(peer smtpd.Peer, env smtpd.Envelope) err
 
 		return nil
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+)
+
+// Message is a flattened MIME tree: either a leaf with a raw, decoded body,
+// or a branch with Children and no Body.
+type Message struct {
+	Headers  mail.Header
+	Body     []byte
+	Children []*Message
+}
+
+// ParseEmail parses a raw RFC 5322 message into a Message tree. Charset
+// decoding (ISO-8859-1, GB2312, ...) and multipart walking, including
+// nested multipart/related parts, are handled by go-message.
+func ParseEmail(r io.Reader) (*Message, error) {
+	entity, err := message.Read(r)
+	if message.IsUnknownCharset(err) {
+		// Fall through with whatever go-message could still decode.
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entityToMessage(entity)
+}
+
+func entityToMessage(entity *message.Entity) (*Message, error) {
+	msg := &Message{
+		Headers: headerToMailHeader(entity.Header),
+	}
+
+	if mr := entity.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			child, err := entityToMessage(part)
+			if err != nil {
+				return nil, err
+			}
+
+			msg.Children = append(msg.Children, child)
+		}
+
+		return msg, nil
+	}
+
+	body, err := ioutil.ReadAll(entity.Body)
+	if err != nil {
+		return nil, err
+	}
+	msg.Body = body
+
+	return msg, nil
+}
+
+// headerToMailHeader copies a go-message Header into a net/mail.Header so
+// the rest of the handler can keep using Get/AddressList as before.
+func headerToMailHeader(h message.Header) mail.Header {
+	out := mail.Header{}
+
+	fields := h.Fields()
+	for fields.Next() {
+		key := textproto.CanonicalMIMEHeaderKey(fields.Key())
+		out[key] = append(out[key], fields.Value())
+	}
+
+	return out
+}
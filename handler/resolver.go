@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+)
+
+var (
+	// ErrDomainNotSupported is returned by AddressResolver.Resolve when the
+	// recipient's domain isn't one this deployment accepts mail for. The
+	// caller skips such recipients rather than failing the whole delivery.
+	ErrDomainNotSupported = errors.New("domain not supported")
+	// ErrAccountNotFound is returned when the domain is supported but no
+	// account matches the local part.
+	ErrAccountNotFound = errors.New("account not found")
+)
+
+// AddressResolver resolves an inbound recipient address to the account
+// that should receive it, and that account's primary encryption key. It's
+// the extension point PrepareHandler uses instead of talking to RethinkDB
+// directly, so the SMTP path this package contributes can be tested - and
+// deployed - without it.
+type AddressResolver interface {
+	Resolve(ctx context.Context, localPart, domain string) (*models.Account, error)
+	PrimaryKey(ctx context.Context, account *models.Account) (*models.Key, error)
+}
+
+// RethinkResolver is the default AddressResolver: it accepts mail for
+// config.Domains and looks accounts up by name in RethinkDB, exactly as
+// this package always has.
+type RethinkResolver struct {
+	Config  *Flags
+	Session *gorethink.Session
+}
+
+// Resolve implements AddressResolver.
+func (r *RethinkResolver) Resolve(ctx context.Context, localPart, domain string) (*models.Account, error) {
+	supported := false
+	for _, candidate := range r.Config.Domains {
+		if candidate == domain {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, ErrDomainNotSupported
+	}
+
+	cursor, err := gorethink.Db(r.Config.RethinkDatabase).Table("accounts").GetAllByIndex("name", localPart).Run(r.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	var account *models.Account
+	if err := cursor.One(&account); err != nil {
+		return nil, ErrAccountNotFound
+	}
+
+	return account, nil
+}
+
+// PrimaryKey implements AddressResolver. If the account has a designated
+// PublicKey it's used, otherwise the first key owned by the account is.
+func (r *RethinkResolver) PrimaryKey(ctx context.Context, account *models.Account) (*models.Key, error) {
+	if account.PublicKey != "" {
+		cursor, err := gorethink.Db(r.Config.RethinkDatabase).Table("keys").Get(account.PublicKey).Run(r.Session)
+		if err != nil {
+			return nil, err
+		}
+
+		var key *models.Key
+		if err := cursor.One(&key); err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	}
+
+	cursor, err := gorethink.Db(r.Config.RethinkDatabase).Table("keys").GetAllByIndex("owner", account.ID).Run(r.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*models.Key
+	if err := cursor.All(&keys); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("Recipient has no public key")
+	}
+
+	return keys[0], nil
+}
+
+// PlusAddressingResolver wraps another AddressResolver and strips a
+// Gmail-style "+tag" suffix from the local part before delegating, so
+// users can hand out "name+filter@domain" addresses for client-side
+// filtering without provisioning a separate account.
+type PlusAddressingResolver struct {
+	Next AddressResolver
+}
+
+// Resolve implements AddressResolver.
+func (r *PlusAddressingResolver) Resolve(ctx context.Context, localPart, domain string) (*models.Account, error) {
+	if i := strings.Index(localPart, "+"); i != -1 {
+		localPart = localPart[:i]
+	}
+
+	return r.Next.Resolve(ctx, localPart, domain)
+}
+
+// PrimaryKey implements AddressResolver.
+func (r *PlusAddressingResolver) PrimaryKey(ctx context.Context, account *models.Account) (*models.Key, error) {
+	return r.Next.PrimaryKey(ctx, account)
+}
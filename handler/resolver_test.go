@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lavab/api/models"
+)
+
+// fakeResolver is a minimal in-memory AddressResolver, standing in for
+// RethinkResolver so PlusAddressingResolver can be exercised without a
+// RethinkDB session.
+type fakeResolver struct {
+	account *models.Account
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, localPart, domain string) (*models.Account, error) {
+	if localPart != "alice" {
+		return nil, ErrAccountNotFound
+	}
+
+	return r.account, nil
+}
+
+func (r *fakeResolver) PrimaryKey(ctx context.Context, account *models.Account) (*models.Key, error) {
+	return nil, nil
+}
+
+func TestPlusAddressingResolverStripsTag(t *testing.T) {
+	next := &fakeResolver{account: &models.Account{Resource: models.Resource{ID: "acc-alice"}}}
+	r := &PlusAddressingResolver{Next: next}
+
+	account, err := r.Resolve(context.Background(), "alice+lists", "example.com")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+	if account.ID != "acc-alice" {
+		t.Fatalf("expected acc-alice, got %s", account.ID)
+	}
+}
+
+func TestPlusAddressingResolverNoTag(t *testing.T) {
+	next := &fakeResolver{account: &models.Account{Resource: models.Resource{ID: "acc-alice"}}}
+	r := &PlusAddressingResolver{Next: next}
+
+	account, err := r.Resolve(context.Background(), "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+	if account.ID != "acc-alice" {
+		t.Fatalf("expected acc-alice, got %s", account.ID)
+	}
+}
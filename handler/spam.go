@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/teamwork/spamc"
+)
+
+// SpamReport is the spamd verdict for a single message. It's persisted
+// onto the stored models.Email so the web client can explain why a
+// message ended up in Spam.
+type SpamReport struct {
+	Score   float64  `json:"score"`
+	IsSpam  bool     `json:"is_spam"`
+	Symbols []string `json:"symbols"`
+}
+
+// defaultSpamThreshold is SpamAssassin's own conventional cutoff, used when
+// Flags.SpamThreshold is left at its zero value so an unset threshold
+// doesn't mean "everything is spam".
+const defaultSpamThreshold = 5.0
+
+// scoreSpam reports raw to spamd and returns its verdict. spamd failures
+// are non-fatal: the caller gets a nil report and the message is treated
+// as ham rather than blocking delivery.
+func scoreSpam(log *logrus.Logger, address string, threshold float64, raw []byte) *SpamReport {
+	if address == "" {
+		return nil
+	}
+
+	if threshold <= 0 {
+		threshold = defaultSpamThreshold
+	}
+
+	client := spamc.New(address, nil)
+
+	report, err := client.Report(context.Background(), bytes.NewReader(raw), nil)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("spamd report failed, treating message as ham")
+
+		return nil
+	}
+
+	symbols := make([]string, len(report.Rules))
+	for i, rule := range report.Rules {
+		symbols[i] = rule.Name
+	}
+
+	return &SpamReport{
+		Score:   report.Score,
+		IsSpam:  report.Score >= threshold,
+		Symbols: symbols,
+	}
+}
@@ -0,0 +1,90 @@
+// Package imap exposes the mail stored by the handler package over IMAP,
+// so that standard clients (Thunderbird/Enigmail, Apple Mail, ...) can pull
+// and decrypt it client-side, instead of requiring the web client.
+package imap
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dancannon/gorethink"
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/lavab/api/models"
+)
+
+// Flags configures Backend. It mirrors handler.Flags for the pieces the
+// IMAP frontend needs; the two are kept separate so the IMAP listener can
+// be run as its own process against the same RethinkDB.
+type Flags struct {
+	RethinkAddress  string
+	RethinkKey      string
+	RethinkDatabase string
+
+	NSQDAddress      string
+	NSQLookupAddress string
+}
+
+// Backend implements github.com/emersion/go-imap/backend against the
+// RethinkDB schema the handler package writes into (emails, threads,
+// labels, files).
+type Backend struct {
+	config  *Flags
+	log     *logrus.Logger
+	session *gorethink.Session
+
+	// Updates is consumed by go-imap's IDLE support. idleNotifier forwards
+	// email_receipt NSQ messages onto it so new mail shows up without
+	// polling.
+	Updates chan backend.Update
+}
+
+// New connects to RethinkDB and subscribes to the email_receipt NSQ topic,
+// returning a Backend ready to be handed to an imapserver.Server.
+func New(config *Flags, log *logrus.Logger) (*Backend, error) {
+	session, err := gorethink.Connect(gorethink.ConnectOpts{
+		Address: config.RethinkAddress,
+		AuthKey: config.RethinkKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backend{
+		config:  config,
+		log:     log,
+		session: session,
+		Updates: make(chan backend.Update, 64),
+	}
+
+	if err := b.startIdleNotifier(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Login implements backend.Backend. Credentials are checked against the
+// same accounts table the SMTP handler resolves recipients from.
+func (b *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	cursor, err := gorethink.Db(b.config.RethinkDatabase).Table("accounts").Filter(map[string]interface{}{
+		"name": username,
+	}).Run(b.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var acc *models.Account
+	if err := cursor.One(&acc); err != nil {
+		return nil, fmt.Errorf("Unknown user")
+	}
+
+	// CheckPassword already exists on github.com/lavab/api/models.Account -
+	// it's the same bcrypt check the web API's own login uses, not a new
+	// field this series is adding there.
+	if !acc.CheckPassword(password) {
+		return nil, fmt.Errorf("Invalid credentials")
+	}
+
+	return &User{backend: b, account: acc}, nil
+}
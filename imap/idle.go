@@ -0,0 +1,55 @@
+package imap
+
+import (
+	"encoding/json"
+
+	"github.com/bitly/go-nsq"
+	"github.com/emersion/go-imap/backend"
+)
+
+// emailReceipt mirrors the notification the handler package publishes to
+// the email_receipt topic.
+type emailReceipt struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	Label string `json:"label"`
+}
+
+// startIdleNotifier subscribes to the email_receipt NSQ topic and forwards
+// each delivery onto b.Updates, so IMAP IDLE connections see new messages
+// without polling RethinkDB.
+func (b *Backend) startIdleNotifier() error {
+	consumer, err := nsq.NewConsumer("email_receipt", "imap", nsq.NewConfig())
+	if err != nil {
+		return err
+	}
+
+	consumer.AddHandler(nsq.HandlerFunc(func(msg *nsq.Message) error {
+		var receipt emailReceipt
+		if err := json.Unmarshal(msg.Body, &receipt); err != nil {
+			// Not our payload shape, or a stale publisher - skip it
+			// rather than failing the whole subscription.
+			return nil
+		}
+
+		// Deliveries don't always land in Inbox - spamd hits and
+		// DMARC-quarantined mail are filed into Spam/Quarantine instead,
+		// so notify whichever mailbox the message actually landed in.
+		mailbox := receipt.Label
+		if mapped, ok := builtinMailboxes[receipt.Label]; ok {
+			mailbox = mapped
+		}
+
+		b.Updates <- &backend.MailboxUpdate{
+			Update: backend.NewUpdate(receipt.Owner, mailbox),
+		}
+
+		return nil
+	}))
+
+	if b.config.NSQLookupAddress != "" {
+		return consumer.ConnectToNSQLookupd(b.config.NSQLookupAddress)
+	}
+
+	return consumer.ConnectToNSQD(b.config.NSQDAddress)
+}
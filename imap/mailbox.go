@@ -0,0 +1,727 @@
+package imap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	specialuse "github.com/emersion/go-imap-specialuse"
+	"github.com/lavab/api/models"
+)
+
+// Mailbox implements backend.Mailbox (plus the go-imap-move extension) over
+// a single label. Membership and sequence numbers are derived from the
+// ordered list of threads carrying that label; UIDs are persisted
+// separately (see uid.go), since a message's position in that list shifts
+// as threads are added, moved or relabeled and a UID must not.
+type Mailbox struct {
+	user  *User
+	label *models.Label
+}
+
+// Name implements backend.Mailbox.
+func (m *Mailbox) Name() string {
+	if m.label.Builtin {
+		if name, ok := builtinMailboxes[m.label.Name]; ok {
+			return name
+		}
+	}
+
+	return m.label.Name
+}
+
+// Info implements backend.Mailbox.
+func (m *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Name:       m.Name(),
+		Delimiter:  "/",
+		Attributes: []string{},
+	}
+
+	if m.label.Builtin && m.label.Name == "Archive" {
+		info.Attributes = append(info.Attributes, specialuse.All)
+	}
+
+	return info, nil
+}
+
+// Status implements backend.Mailbox.
+func (m *Mailbox) Status(items []string) (*imap.MailboxStatus, error) {
+	emails, err := m.emails()
+	if err != nil {
+		return nil, err
+	}
+
+	_, state, err := m.assignUIDs(emails)
+	if err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(m.Name(), items)
+	status.Flags = []string{string(imap.SeenFlag), string(imap.FlaggedFlag), string(imap.DeletedFlag)}
+	status.PermanentFlags = []string{string(imap.SeenFlag)}
+	status.UidValidity = state.UidValidity
+	status.Messages = uint32(len(emails))
+	status.UidNext = state.UidNext
+
+	return status, nil
+}
+
+// assignUIDs is a thin wrapper around the package-level assignUIDs that
+// supplies this mailbox's session/database/label.
+func (m *Mailbox) assignUIDs(emails []*models.Email) (map[string]uint32, *mailboxUIDState, error) {
+	emailIDs := make([]string, len(emails))
+	for i, email := range emails {
+		emailIDs[i] = email.ID
+	}
+
+	return assignUIDs(m.user.backend.session, m.user.backend.config.RethinkDatabase, m.label.ID, emailIDs)
+}
+
+// SetSubscribed implements backend.Mailbox. Every label is always
+// considered subscribed.
+func (m *Mailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+// Check implements backend.Mailbox.
+func (m *Mailbox) Check() error {
+	return nil
+}
+
+// ListMessages implements backend.Mailbox.
+func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []string, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	emails, err := m.emails()
+	if err != nil {
+		return err
+	}
+
+	uids, _, err := m.assignUIDs(emails)
+	if err != nil {
+		return err
+	}
+
+	for i, email := range emails {
+		seqNum := uint32(i + 1)
+		msgUid := uids[email.ID]
+
+		selector := seqNum
+		if uid {
+			selector = msgUid
+		}
+		if !seqset.Contains(selector) {
+			continue
+		}
+
+		msg, err := m.buildMessage(email, seqNum, msgUid, items)
+		if err != nil {
+			return err
+		}
+
+		ch <- msg
+	}
+
+	return nil
+}
+
+// SearchMessages implements backend.Mailbox. It evaluates sequence/UID
+// sets, the Since/Before/SentSince/SentBefore date ranges and the \Seen
+// flag - the same state this package tracks elsewhere (see
+// UpdateMessagesFlags). Header/Body/Text criteria are not evaluated and do
+// not narrow the result, since nothing here keeps a searchable index of
+// message content.
+func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	emails, err := m.emails()
+	if err != nil {
+		return nil, err
+	}
+
+	uids, _, err := m.assignUIDs(emails)
+	if err != nil {
+		return nil, err
+	}
+
+	isRead, err := m.readStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []uint32{}
+	for i, email := range emails {
+		seqNum := uint32(i + 1)
+		msgUid := uids[email.ID]
+
+		if !matchesCriteria(criteria, seqNum, msgUid, email, isRead[email.ID]) {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, msgUid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+
+	return ids, nil
+}
+
+// matchesCriteria reports whether email, at the given sequence number/UID
+// and \Seen state, satisfies criteria. A nil criteria matches everything.
+func matchesCriteria(criteria *imap.SearchCriteria, seqNum, msgUid uint32, email *models.Email, seen bool) bool {
+	if criteria == nil {
+		return true
+	}
+
+	if criteria.SeqNum != nil && !criteria.SeqNum.Contains(seqNum) {
+		return false
+	}
+	if criteria.Uid != nil && !criteria.Uid.Contains(msgUid) {
+		return false
+	}
+
+	if !criteria.Since.IsZero() && email.DateCreated.Before(criteria.Since) {
+		return false
+	}
+	if !criteria.Before.IsZero() && !email.DateCreated.Before(criteria.Before) {
+		return false
+	}
+	if !criteria.SentSince.IsZero() && email.DateCreated.Before(criteria.SentSince) {
+		return false
+	}
+	if !criteria.SentBefore.IsZero() && !email.DateCreated.Before(criteria.SentBefore) {
+		return false
+	}
+
+	for _, flag := range criteria.WithFlags {
+		if flag == string(imap.SeenFlag) && !seen {
+			return false
+		}
+	}
+	for _, flag := range criteria.WithoutFlags {
+		if flag == string(imap.SeenFlag) && seen {
+			return false
+		}
+	}
+
+	for _, sub := range criteria.Not {
+		if matchesCriteria(sub, seqNum, msgUid, email, seen) {
+			return false
+		}
+	}
+
+	for _, pair := range criteria.Or {
+		if !matchesCriteria(pair[0], seqNum, msgUid, email, seen) && !matchesCriteria(pair[1], seqNum, msgUid, email, seen) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readStatus maps every email ID filed under this label to its owning
+// thread's \Seen state.
+func (m *Mailbox) readStatus() (map[string]bool, error) {
+	threads, err := m.orderedThreads()
+	if err != nil {
+		return nil, err
+	}
+
+	status := map[string]bool{}
+	for _, thread := range threads {
+		for _, eid := range thread.Emails {
+			status[eid] = thread.IsRead
+		}
+	}
+
+	return status, nil
+}
+
+// CreateMessage implements backend.Mailbox, used for APPEND (saving Drafts,
+// archiving Sent mail). The literal itself is stored as-is - whatever PGP
+// framing the client already applied is preserved rather than re-derived -
+// but its headers are parsed so Name/From/To/CC line up with what
+// buildMessage's ENVELOPE reports for every other message in the mailbox.
+func (m *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	var subject, from string
+	var to, cc []string
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		subject = parsed.Header.Get("Subject")
+		from = strings.TrimSpace(parsed.Header.Get("From"))
+		if v := parsed.Header.Get("To"); v != "" {
+			to = strings.Split(v, ", ")
+		}
+		if v := parsed.Header.Get("Cc"); v != "" {
+			cc = strings.Split(v, ", ")
+		}
+	}
+
+	eid := uniuri.NewLen(uniuri.UUIDLen)
+	tid := uniuri.NewLen(uniuri.UUIDLen)
+
+	email := &models.Email{
+		Resource: models.Resource{
+			ID:           eid,
+			DateCreated:  date,
+			DateModified: date,
+			Name:         subject,
+			Owner:        m.user.account.ID,
+		},
+		Kind:   "raw",
+		From:   from,
+		To:     to,
+		CC:     cc,
+		Body:   string(raw),
+		Thread: tid,
+		Status: "received",
+	}
+
+	thread := &models.Thread{
+		Resource: models.Resource{
+			ID:           tid,
+			DateCreated:  date,
+			DateModified: date,
+			Name:         "IMAP append",
+			Owner:        m.user.account.ID,
+		},
+		Emails: []string{eid},
+		Labels: []string{m.label.ID},
+	}
+
+	db := gorethink.Db(m.user.backend.config.RethinkDatabase)
+	if _, err := db.Table("emails").Insert(email).Run(m.user.backend.session); err != nil {
+		return err
+	}
+	if _, err := db.Table("threads").Insert(thread).Run(m.user.backend.session); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateMessagesFlags implements backend.Mailbox. Only \Seen is tracked,
+// via the owning thread's IsRead field - there's nowhere else in the
+// schema to keep per-message IMAP flags yet.
+func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	seen := false
+	for _, flag := range flags {
+		if flag == string(imap.SeenFlag) {
+			seen = true
+		}
+	}
+	if !seen {
+		return nil
+	}
+
+	isRead := operation == imap.SetFlags || operation == imap.AddFlags
+
+	threads, err := m.threadsForSeqset(seqset)
+	if err != nil {
+		return err
+	}
+
+	db := gorethink.Db(m.user.backend.config.RethinkDatabase)
+	for _, thread := range threads {
+		if _, err := db.Table("threads").Get(thread.ID).Update(map[string]interface{}{
+			"is_read": isRead,
+		}).Run(m.user.backend.session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CopyMessages implements backend.Mailbox by adding dest's label to the
+// owning threads, alongside the source label.
+func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return m.retagMessages(seqset, dest, true)
+}
+
+// MoveMessages implements the go-imap-move extension's move.Mailbox.
+func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return m.retagMessages(seqset, dest, false)
+}
+
+// Expunge implements backend.Mailbox. There's no persisted \Deleted flag
+// yet, so there's nothing to purge.
+func (m *Mailbox) Expunge() error {
+	return nil
+}
+
+func (m *Mailbox) retagMessages(seqset *imap.SeqSet, dest string, keepSource bool) error {
+	destLabel, err := m.user.findLabel(dest)
+	if err != nil {
+		return err
+	}
+
+	selections, err := m.selectionsForSeqset(seqset)
+	if err != nil {
+		return err
+	}
+
+	db := gorethink.Db(m.user.backend.config.RethinkDatabase)
+	for _, sel := range selections {
+		thread := sel.thread
+		if len(sel.emails) < len(thread.Emails) {
+			// Labels live on the thread, not the email, so relabeling the
+			// whole thread would drag along messages the client never
+			// selected. Split the selected messages into a thread of
+			// their own first, leaving the rest where they were.
+			thread, err = m.splitThread(thread, sel.emails)
+			if err != nil {
+				return err
+			}
+		}
+
+		labels := thread.Labels
+		if !keepSource {
+			filtered := labels[:0]
+			for _, id := range labels {
+				if id != m.label.ID {
+					filtered = append(filtered, id)
+				}
+			}
+			labels = filtered
+		}
+
+		hasDest := false
+		for _, id := range labels {
+			if id == destLabel.ID {
+				hasDest = true
+				break
+			}
+		}
+		if !hasDest {
+			labels = append(labels, destLabel.ID)
+		}
+
+		if _, err := db.Table("threads").Get(thread.ID).Update(map[string]interface{}{
+			"labels": labels,
+		}).Run(m.user.backend.session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// threadSelection is a thread backing one or more messages selected out of
+// a seqset, along with which of its emails were actually selected.
+type threadSelection struct {
+	thread *models.Thread
+	emails []string
+}
+
+// selectionsForSeqset resolves the threads backing the messages selected by
+// seqset, in the same order emails() would list them, along with exactly
+// which email(s) of each thread were selected - so callers that need to
+// act on a single message rather than its whole thread can tell the two
+// apart.
+func (m *Mailbox) selectionsForSeqset(seqset *imap.SeqSet) ([]*threadSelection, error) {
+	threads, err := m.orderedThreads()
+	if err != nil {
+		return nil, err
+	}
+
+	selections := []*threadSelection{}
+	num := uint32(0)
+	for _, thread := range threads {
+		var selected []string
+		for _, eid := range thread.Emails {
+			num++
+			if seqset.Contains(num) {
+				selected = append(selected, eid)
+			}
+		}
+		if len(selected) > 0 {
+			selections = append(selections, &threadSelection{thread: thread, emails: selected})
+		}
+	}
+
+	return selections, nil
+}
+
+// splitThread pulls emailIDs out of thread into a new thread of their own,
+// carrying over everything but Emails/ID, and leaves thread with whatever
+// emails remain. Used before retagging a subset of a thread's messages, so
+// the rest of the conversation isn't relabeled along with them.
+func (m *Mailbox) splitThread(thread *models.Thread, emailIDs []string) (*models.Thread, error) {
+	selected := map[string]bool{}
+	for _, id := range emailIDs {
+		selected[id] = true
+	}
+
+	remaining := make([]string, 0, len(thread.Emails))
+	for _, id := range thread.Emails {
+		if !selected[id] {
+			remaining = append(remaining, id)
+		}
+	}
+
+	split := &models.Thread{
+		Resource: models.Resource{
+			ID:           uniuri.NewLen(uniuri.UUIDLen),
+			DateCreated:  thread.DateCreated,
+			DateModified: thread.DateModified,
+			Name:         thread.Name,
+			Owner:        thread.Owner,
+		},
+		Emails:      append([]string{}, emailIDs...),
+		Labels:      append([]string{}, thread.Labels...),
+		Members:     thread.Members,
+		IsRead:      thread.IsRead,
+		IsSpam:      thread.IsSpam,
+		SubjectHash: thread.SubjectHash,
+	}
+
+	db := gorethink.Db(m.user.backend.config.RethinkDatabase)
+	if _, err := db.Table("threads").Insert(split).Run(m.user.backend.session); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Table("threads").Get(thread.ID).Update(map[string]interface{}{
+		"emails": remaining,
+	}).Run(m.user.backend.session); err != nil {
+		return nil, err
+	}
+
+	// The moved emails' own Thread field - the same one handler.go sets on
+	// delivery - has to follow them, or a lookup via Email.Thread still
+	// points at the thread they were just split out of.
+	movedIDs := make([]interface{}, len(emailIDs))
+	for i, id := range emailIDs {
+		movedIDs[i] = id
+	}
+	if _, err := db.Table("emails").GetAll(movedIDs...).Update(map[string]interface{}{
+		"thread": split.ID,
+	}).Run(m.user.backend.session); err != nil {
+		return nil, err
+	}
+
+	return split, nil
+}
+
+// threadsForSeqset resolves the threads backing the messages selected by
+// seqset, in the same order emails() would list them.
+func (m *Mailbox) threadsForSeqset(seqset *imap.SeqSet) ([]*models.Thread, error) {
+	threads, err := m.orderedThreads()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []*models.Thread{}
+	num := uint32(0)
+	for _, thread := range threads {
+		for range thread.Emails {
+			num++
+			if seqset.Contains(num) {
+				selected = append(selected, thread)
+				break
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+func (m *Mailbox) orderedThreads() ([]*models.Thread, error) {
+	cursor, err := gorethink.Db(m.user.backend.config.RethinkDatabase).Table("threads").Filter(func(row gorethink.Term) gorethink.Term {
+		return row.Field("labels").Contains(m.label.ID)
+	}).OrderBy(gorethink.Asc("date_created")).Run(m.user.backend.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var threads []*models.Thread
+	if err := cursor.All(&threads); err != nil {
+		return nil, err
+	}
+
+	return threads, nil
+}
+
+// emails returns every message filed under this label, in the stable
+// thread order that sequence numbers and UIDs are both derived from.
+func (m *Mailbox) emails() ([]*models.Email, error) {
+	threads, err := m.orderedThreads()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []interface{}{}
+	for _, thread := range threads {
+		for _, id := range thread.Emails {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cursor, err := gorethink.Db(m.user.backend.config.RethinkDatabase).Table("emails").GetAll(ids...).Run(m.user.backend.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var fetched []*models.Email
+	if err := cursor.All(&fetched); err != nil {
+		return nil, err
+	}
+
+	byID := map[string]*models.Email{}
+	for _, email := range fetched {
+		byID[email.ID] = email
+	}
+
+	emails := make([]*models.Email, 0, len(ids))
+	for _, id := range ids {
+		if email, ok := byID[id.(string)]; ok {
+			emails = append(emails, email)
+		}
+	}
+
+	return emails, nil
+}
+
+// attachmentsFor fetches the files attached to email, in storage order.
+func (m *Mailbox) attachmentsFor(email *models.Email) ([]*models.File, error) {
+	if len(email.Files) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]interface{}, len(email.Files))
+	for i, id := range email.Files {
+		ids[i] = id
+	}
+
+	cursor, err := gorethink.Db(m.user.backend.config.RethinkDatabase).Table("files").GetAll(ids...).Run(m.user.backend.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*models.File
+	if err := cursor.All(&files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// buildMessage turns a stored email into an imap.Message, filling in only
+// the items that were asked for. seqNum is the message's position in this
+// listing; msgUid is its stable, persisted UID (see uid.go) - the two are
+// no longer the same value once a thread is added, moved or relabeled.
+func (m *Mailbox) buildMessage(email *models.Email, seqNum, msgUid uint32, items []string) (*imap.Message, error) {
+	msg := imap.NewMessage(seqNum, items)
+
+	var raw []byte
+	for _, item := range items {
+		if item == string(imap.FetchRFC822Size) || strings.HasPrefix(item, "BODY") || strings.HasPrefix(item, "RFC822") {
+			files, err := m.attachmentsFor(email)
+			if err != nil {
+				return nil, err
+			}
+
+			raw, err = buildRawMessage(email, files)
+			if err != nil {
+				return nil, err
+			}
+
+			break
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case string(imap.FetchUid):
+			msg.Uid = msgUid
+		case string(imap.FetchFlags):
+			msg.Flags = []string{}
+		case string(imap.FetchInternalDate):
+			msg.InternalDate = email.DateCreated
+		case string(imap.FetchRFC822Size):
+			msg.Size = uint32(len(raw))
+		case string(imap.FetchEnvelope):
+			msg.Envelope = &imap.Envelope{
+				Date:    email.DateCreated,
+				Subject: email.Name,
+				From:    addressList(email.From),
+				To:      addressListAll(email.To),
+				Cc:      addressListAll(email.CC),
+			}
+		default:
+			if strings.HasPrefix(item, "BODY") || strings.HasPrefix(item, "RFC822") {
+				// Section-specific fetches aren't parsed out yet - every
+				// BODY/RFC822 request gets the whole reassembled message.
+				msg.Body[&imap.BodySectionName{}] = bytes.NewReader(raw)
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+func addressList(addr string) []*imap.Address {
+	if addr == "" {
+		return nil
+	}
+
+	return []*imap.Address{parseAddress(addr)}
+}
+
+func addressListAll(addrs []string) []*imap.Address {
+	list := make([]*imap.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+
+		list = append(list, parseAddress(addr))
+	}
+
+	return list
+}
+
+// parseAddress splits a "name <user@host>" or bare "user@host" string into
+// an *imap.Address, so MailboxName/HostName line up the way ENVELOPE
+// requires instead of stuffing the whole address into MailboxName.
+func parseAddress(addr string) *imap.Address {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return &imap.Address{MailboxName: addr}
+	}
+
+	mailboxName := parsed.Address
+	hostName := ""
+	if i := strings.LastIndex(parsed.Address, "@"); i != -1 {
+		mailboxName = parsed.Address[:i]
+		hostName = parsed.Address[i+1:]
+	}
+
+	return &imap.Address{
+		PersonalName: parsed.Name,
+		MailboxName:  mailboxName,
+		HostName:     hostName,
+	}
+}
+
+var _ backend.Mailbox = (*Mailbox)(nil)
+
+// Ensure Mailbox satisfies the go-imap-move extension too.
+var _ interface {
+	MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
+} = (*Mailbox)(nil)
@@ -0,0 +1,90 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/lavab/api/models"
+)
+
+// buildRawMessage reassembles the RFC 5322 message that PrepareHandler
+// split into body/manifest/files on receipt, for IMAP FETCH. Every part is
+// written back out exactly as it was stored - still PGP-encrypted - so
+// clients like Enigmail/Thunderbird do the decryption themselves.
+func buildRawMessage(email *models.Email, files []*models.File) ([]byte, error) {
+	out := &bytes.Buffer{}
+
+	fmt.Fprintf(out, "From: %s\r\n", email.From)
+	fmt.Fprintf(out, "To: %s\r\n", strings.Join(email.To, ", "))
+	if len(email.CC) > 0 {
+		fmt.Fprintf(out, "Cc: %s\r\n", strings.Join(email.CC, ", "))
+	}
+	fmt.Fprintf(out, "Subject: %s\r\n", email.Name)
+	fmt.Fprintf(out, "Date: %s\r\n", email.DateCreated.Format(time.RFC1123Z))
+	fmt.Fprintf(out, "MIME-Version: 1.0\r\n")
+
+	// The encrypted body goes into its own multipart/alternative, exactly
+	// as PrepareHandler expects to find it on the way in.
+	bodyBuf := &bytes.Buffer{}
+	bodyWriter := multipart.NewWriter(bodyBuf)
+	bodyPart, err := bodyWriter.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"application/pgp-encrypted"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bodyPart.Write([]byte(email.Body)); err != nil {
+		return nil, err
+	}
+	if err := bodyWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	mixedWriter := multipart.NewWriter(out)
+	fmt.Fprintf(out, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mixedWriter.Boundary())
+
+	if email.Manifest != "" {
+		manifestPart, err := mixedWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/x-pgp-manifest"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := manifestPart.Write([]byte(email.Manifest)); err != nil {
+			return nil, err
+		}
+	}
+
+	altPart, err := mixedWriter.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%q", bodyWriter.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := altPart.Write(bodyBuf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		filePart, err := mixedWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"application/pgp-encrypted"},
+			"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", file.Name)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := filePart.Write([]byte(file.Data)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixedWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
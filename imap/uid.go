@@ -0,0 +1,148 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/dancannon/gorethink"
+)
+
+// mailboxUIDState is the persisted UIDVALIDITY/next-UID counter for a
+// single label, stored in its own table so a UID survives across sessions
+// instead of being re-derived from a message's position in the
+// thread-ordered list - which silently re-points a UID at a different
+// message whenever a thread is added, moved or relabeled.
+type mailboxUIDState struct {
+	ID          string `gorethink:"id"`
+	UidValidity uint32 `gorethink:"uid_validity"`
+	UidNext     uint32 `gorethink:"uid_next"`
+}
+
+// messageUID is the persisted mapping from an (label, email) pair to the
+// UID it was assigned the first time it was seen in that label's mailbox.
+type messageUID struct {
+	ID    string `gorethink:"id"`
+	Label string `gorethink:"label"`
+	Email string `gorethink:"email"`
+	Uid   uint32 `gorethink:"uid"`
+}
+
+// mailboxState fetches labelID's UID counter, creating it with
+// UIDVALIDITY 1 the first time the label is seen.
+func mailboxState(session *gorethink.Session, db string, labelID string) (*mailboxUIDState, error) {
+	cursor, err := gorethink.Db(db).Table("imap_mailboxes").Get(labelID).Run(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var state *mailboxUIDState
+	if err := cursor.One(&state); err != nil {
+		state = &mailboxUIDState{
+			ID:          labelID,
+			UidValidity: 1,
+			UidNext:     1,
+		}
+
+		if _, err := gorethink.Db(db).Table("imap_mailboxes").Insert(state).Run(session); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// assignUIDs returns the persisted UID for every ID in emailIDs, handing
+// out and storing a fresh one from labelID's counter for any email seen
+// for the first time. The returned state reflects UidNext after any new
+// assignments.
+func assignUIDs(session *gorethink.Session, db string, labelID string, emailIDs []string) (map[string]uint32, *mailboxUIDState, error) {
+	state, err := mailboxState(session, db, labelID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]interface{}, len(emailIDs))
+	for i, eid := range emailIDs {
+		ids[i] = labelID + ":" + eid
+	}
+
+	uids := map[string]uint32{}
+	if len(ids) > 0 {
+		cursor, err := gorethink.Db(db).Table("imap_uids").GetAll(ids...).Run(session)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var existing []*messageUID
+		if err := cursor.All(&existing); err != nil {
+			return nil, nil, err
+		}
+
+		for _, m := range existing {
+			uids[m.Email] = m.Uid
+		}
+	}
+
+	newIDs := make([]string, 0, len(emailIDs))
+	for _, eid := range emailIDs {
+		if _, ok := uids[eid]; !ok {
+			newIDs = append(newIDs, eid)
+		}
+	}
+
+	if len(newIDs) > 0 {
+		firstUID, err := reserveUIDs(session, db, labelID, uint32(len(newIDs)))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i, eid := range newIDs {
+			uid := firstUID + uint32(i)
+			uids[eid] = uid
+
+			if _, err := gorethink.Db(db).Table("imap_uids").Insert(&messageUID{
+				ID:    labelID + ":" + eid,
+				Label: labelID,
+				Email: eid,
+				Uid:   uid,
+			}).Run(session); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		state.UidNext = firstUID + uint32(len(newIDs))
+	}
+
+	return uids, state, nil
+}
+
+// reserveUIDs atomically reserves n consecutive UIDs out of labelID's
+// counter and returns the first one, via a ReQL update expression rather
+// than a separate read/increment/write - so two connections assigning
+// UIDs for the same mailbox at once each get a disjoint range instead of
+// racing to hand out the same value twice.
+func reserveUIDs(session *gorethink.Session, db string, labelID string, n uint32) (uint32, error) {
+	res, err := gorethink.Db(db).Table("imap_mailboxes").Get(labelID).Update(func(row gorethink.Term) interface{} {
+		return map[string]interface{}{
+			"uid_next": row.Field("uid_next").Add(n),
+		}
+	}, gorethink.UpdateOpts{ReturnChanges: true}).RunWrite(session)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, change := range res.Changes {
+		old, ok := change.OldValue.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch v := old["uid_next"].(type) {
+		case float64:
+			return uint32(v), nil
+		case uint32:
+			return v, nil
+		}
+	}
+
+	return 0, fmt.Errorf("imap: reserveUIDs: no uid_next in update response for label %s", labelID)
+}
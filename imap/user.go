@@ -0,0 +1,158 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/dancannon/gorethink"
+	"github.com/emersion/go-imap/backend"
+	"github.com/lavab/api/models"
+)
+
+// builtinMailboxes maps the built-in labels the rest of the system already
+// uses onto the IMAP mailbox names clients expect.
+var builtinMailboxes = map[string]string{
+	"Inbox":      "INBOX",
+	"Sent":       "Sent",
+	"Spam":       "Spam",
+	"Quarantine": "Quarantine",
+	"Trash":      "Trash",
+	"Drafts":     "Drafts",
+	"Archive":    "Archive",
+}
+
+// User implements backend.User on top of the accounts/labels RethinkDB
+// tables the SMTP handler already writes into.
+type User struct {
+	backend *Backend
+	account *models.Account
+}
+
+// Username implements backend.User.
+func (u *User) Username() string {
+	return u.account.Name
+}
+
+// ListMailboxes implements backend.User. subscribed is ignored: every
+// built-in and user-created label is always considered subscribed.
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	cursor, err := gorethink.Db(u.backend.config.RethinkDatabase).Table("labels").Filter(map[string]interface{}{
+		"owner": u.account.ID,
+	}).Run(u.backend.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []*models.Label
+	if err := cursor.All(&labels); err != nil {
+		return nil, err
+	}
+
+	mailboxes := make([]backend.Mailbox, 0, len(labels))
+	for _, label := range labels {
+		mailboxes = append(mailboxes, &Mailbox{user: u, label: label})
+	}
+
+	return mailboxes, nil
+}
+
+// GetMailbox implements backend.User.
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	label, err := u.findLabel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mailbox{user: u, label: label}, nil
+}
+
+// CreateMailbox implements backend.User. Built-in mailbox names are always
+// refused, whether or not this account already has that built-in label.
+func (u *User) CreateMailbox(name string) error {
+	if _, ok := reverseBuiltin(name); ok {
+		return fmt.Errorf("Mailbox already exists")
+	}
+
+	label := &models.Label{
+		Resource: models.Resource{
+			ID:    fmt.Sprintf("%s-%s", u.account.ID, name),
+			Name:  name,
+			Owner: u.account.ID,
+		},
+		Builtin: false,
+	}
+
+	_, err := gorethink.Db(u.backend.config.RethinkDatabase).Table("labels").Insert(label).Run(u.backend.session)
+	return err
+}
+
+// DeleteMailbox implements backend.User.
+func (u *User) DeleteMailbox(name string) error {
+	label, err := u.findLabel(name)
+	if err != nil {
+		return err
+	}
+
+	if label.Builtin {
+		return fmt.Errorf("Cannot delete a built-in mailbox")
+	}
+
+	_, err = gorethink.Db(u.backend.config.RethinkDatabase).Table("labels").Get(label.ID).Delete().Run(u.backend.session)
+	return err
+}
+
+// RenameMailbox implements backend.User.
+func (u *User) RenameMailbox(existingName, newName string) error {
+	label, err := u.findLabel(existingName)
+	if err != nil {
+		return err
+	}
+
+	if label.Builtin {
+		return fmt.Errorf("Cannot rename a built-in mailbox")
+	}
+
+	_, err = gorethink.Db(u.backend.config.RethinkDatabase).Table("labels").Get(label.ID).Update(map[string]interface{}{
+		"name": newName,
+	}).Run(u.backend.session)
+	return err
+}
+
+// Logout implements backend.User.
+func (u *User) Logout() error {
+	return nil
+}
+
+func (u *User) findLabel(name string) (*models.Label, error) {
+	filter := map[string]interface{}{
+		"owner": u.account.ID,
+		"name":  name,
+	}
+	if builtin, ok := reverseBuiltin(name); ok {
+		filter["name"] = builtin
+		filter["builtin"] = true
+	}
+
+	cursor, err := gorethink.Db(u.backend.config.RethinkDatabase).Table("labels").Filter(filter).Run(u.backend.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var label *models.Label
+	if err := cursor.One(&label); err != nil {
+		return nil, fmt.Errorf("Mailbox does not exist")
+	}
+
+	return label, nil
+}
+
+// reverseBuiltin maps an IMAP mailbox name back to the built-in label name
+// it corresponds to, e.g. "INBOX" -> "Inbox".
+func reverseBuiltin(imapName string) (string, bool) {
+	for label, mailbox := range builtinMailboxes {
+		if mailbox == imapName {
+			return label, true
+		}
+	}
+
+	return "", false
+}